@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/pkg/errors"
+)
+
+// WithDockerConfigAuth pulls the image with the credentials the docker CLI
+// stored for its registry in ~/.docker/config.json ($DOCKER_CONFIG when set),
+// going through the configured credsStore or credHelpers if any.
+func WithDockerConfigAuth() func(*Container) {
+	return func(c *Container) {
+		c.dockerConfigAuth = true
+	}
+}
+
+// dockerHubAuthKey is the key the docker CLI stores Docker Hub credentials under.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+func registryAuthFromConfig(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse image reference")
+	}
+	hostname := reference.Domain(named)
+	if hostname == "docker.io" {
+		hostname = dockerHubAuthKey
+	}
+
+	cfg, err := config.Load(config.Dir())
+	if err != nil {
+		return "", errors.Wrap(err, "unable to load docker config")
+	}
+	auth, err := cfg.GetAuthConfig(hostname)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to get credentials for %s", hostname)
+	}
+
+	encoded, err := registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		ServerAddress: auth.ServerAddress,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode credentials")
+	}
+	return encoded, nil
+}
@@ -1,28 +1,102 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/pkg/errors"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Container struct {
-	ImageToPull       string        // Docker image to be pulled
+	ImageToPull       string        // Docker image to be pulled, or the ID of a local image
+	HostIP            string        // Host IP the ports are published on, "127.0.0.1" by default
 	HostPort          string        // Port to map with container, "9876" by default
 	ContainerPort     string        // Port to map with host
 	ContainerProtocol string        // "tcp" by default
 	BindHostConfig    []string      // List of volume bindings for this container, e.g: []string {"/host/path/to/bind:/container/path/bind"}
 	Env               []string      // Environments to be loaded into the container
-	Cmd               []string      // Commands to be executed into the container after creation
+	SecurityOpt       []string      // Security options for this container, e.g: []string {"apparmor=my-profile"}
+	User              string        // User the container process runs as, e.g: "1000:1000"
+	Hostname          string        // Hostname of the container, its ID by default
+	Domainname        string        // Domain name of the container, resolved with Hostname as its FQDN
+	PostStartCmd      []string      // Commands to be executed into the container right after start, before it is ready
+	Cmd               []string      // Commands to be executed into the container once it is ready
+	CmdTimeout        time.Duration // Maximum time given to Cmd to finish, disabled when zero
+	ExecTTY           bool          // Allocates a TTY to Cmd, false by default whatever the container TTY is
 	Sleep             time.Duration // Time given to container to be ready
+	RunTimeout        time.Duration // Maximum time the container may run before being killed, disabled when zero
+	RestartPolicy     string        // Restart policy of the container, e.g: "on-failure", none by default
+	StopTimeout       time.Duration // Time given to the container to stop before being killed, the daemon's default when zero
+	LogsBufferSize    int           // Maximum bytes of command output and logs kept in memory, 4MB by default
 	client            *client.Client
 	id                string
+	networks          []networkAttachment
+	extraPorts        []nat.Port
+	files             []containerFile
+	mounts            []mount.Mount
+	removeVolumes     bool
+	entrypointWrapper bool
+	resources         container.Resources
+	logStream         io.Writer
+	logPrefix         string
+	annotations       map[string]string
+	logWait           *logWait
+	dockerConfigAuth  bool
+	sysctls           map[string]string
+	sizeAccounting    bool
+	staticIPs         map[string]string
+	requestDump       io.Writer
+	portWait          time.Duration
+	imagePulled       bool
+	restartTolerance  int
+	restartRetries    int
+	noSessionLabel    bool
+	userLabels        map[string]string
+	macAddresses      map[string]string
+	diagnosticLines   int
+	validateMounts    bool
+	volumesFrom       []string
+	runCmd            []string
+	noPortBindings    bool
+	portOptions       bool
+	stopRunTimeout    context.CancelFunc
+	createWarnings    []string
+	optionErr         error
+}
+
+type networkAttachment struct {
+	name    string
+	aliases []string
+}
+
+type containerFile struct {
+	path    string
+	content []byte
+	mode    os.FileMode
 }
 
 func WithContainerProtocol(protocol string) func(*Container) {
@@ -31,9 +105,17 @@ func WithContainerProtocol(protocol string) func(*Container) {
 	}
 }
 
+func WithHostIP(hostIP string) func(*Container) {
+	return func(c *Container) {
+		c.HostIP = hostIP
+		c.portOptions = true
+	}
+}
+
 func WithHostPort(hostPort string) func(*Container) {
 	return func(c *Container) {
 		c.HostPort = hostPort
+		c.portOptions = true
 	}
 }
 
@@ -43,30 +125,567 @@ func WithContainerPort(containerPort string) func(*Container) {
 	}
 }
 
+const maxPortRange = 1000
+
+// WithPortRange maps every container port from start to end to the same port
+// on the host, e.g: passive FTP data ports. When the range includes the
+// container port, that one stays published on HostPort.
+func WithPortRange(startContainer, endContainer int, protocol string) func(*Container) {
+	return func(c *Container) {
+		if startContainer < 1 || endContainer > 65535 || startContainer > endContainer {
+			c.setOptionError(errors.Errorf("invalid port range %d-%d", startContainer, endContainer))
+			return
+		}
+		if endContainer-startContainer >= maxPortRange {
+			c.setOptionError(errors.Errorf("port range %d-%d exceeds %d ports", startContainer, endContainer, maxPortRange))
+			return
+		}
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		for port := startContainer; port <= endContainer; port++ {
+			p, err := nat.NewPort(protocol, strconv.Itoa(port))
+			if err != nil {
+				c.setOptionError(errors.Wrap(err, "unable to get port"))
+				return
+			}
+			c.extraPorts = append(c.extraPorts, p)
+		}
+		c.portOptions = true
+	}
+}
+
+// WithoutPortBindings disables port publishing, for containers whose
+// networking is managed manually. It is implied by the host, none and
+// container network modes, where the daemon refuses to publish ports.
+func WithoutPortBindings() func(*Container) {
+	return func(c *Container) {
+		c.noPortBindings = true
+	}
+}
+
 func WithBindHostConfig(bindHostConfig []string) func(*Container) {
 	return func(c *Container) {
 		c.BindHostConfig = bindHostConfig
 	}
 }
 
+// WithBindDirectory binds a whole host directory into the container, read-only
+// if requested. The host directory must exist when the option is built.
+func WithBindDirectory(hostDir, containerDir string, readOnly bool) func(*Container) {
+	source, err := filepath.Abs(hostDir)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(source); err == nil && !info.IsDir() {
+			err = errors.Errorf("%s is not a directory", hostDir)
+		}
+	}
+	return func(c *Container) {
+		if err != nil {
+			c.setOptionError(errors.Wrap(err, "invalid bind directory"))
+			return
+		}
+		bind := source + ":" + containerDir
+		if readOnly {
+			bind += ":ro"
+		}
+		c.BindHostConfig = append(c.BindHostConfig, bind)
+	}
+}
+
+// WithAppArmorProfile runs the container under an AppArmor profile already
+// loaded on the host. It is added to the other security options.
+func WithAppArmorProfile(name string) func(*Container) {
+	return func(c *Container) {
+		if name == "" {
+			c.setOptionError(errors.New("apparmor profile name cannot be empty"))
+			return
+		}
+		c.SecurityOpt = append(c.SecurityOpt, "apparmor="+name)
+	}
+}
+
+// WithFile writes a file into the container after it is created and before it
+// is started. Parent directories are created when missing.
+func WithFile(containerPath string, content []byte, mode os.FileMode) func(*Container) {
+	return func(c *Container) {
+		if !path.IsAbs(containerPath) {
+			c.setOptionError(errors.Errorf("container path %s must be absolute", containerPath))
+			return
+		}
+		c.files = append(c.files, containerFile{path: path.Clean(containerPath), content: content, mode: mode})
+	}
+}
+
+// WithVolumeMount mounts a named volume into the container. The volume is
+// created by the daemon when missing and reused as is when it already exists,
+// which allows a later container to read what a previous one wrote.
+func WithVolumeMount(volume, target string) func(*Container) {
+	return func(c *Container) {
+		if volume == "" || target == "" {
+			c.setOptionError(errors.New("volume and target cannot be empty"))
+			return
+		}
+		c.mounts = append(c.mounts, mount.Mount{Type: mount.TypeVolume, Source: volume, Target: target})
+	}
+}
+
+// WithMountPropagation bind mounts a host path into the container with the given
+// propagation mode, e.g: "rshared" so mounts made inside it are visible on the host.
+func WithMountPropagation(source, target string, propagation mount.Propagation) func(*Container) {
+	return func(c *Container) {
+		if source == "" || target == "" {
+			c.setOptionError(errors.New("source and target cannot be empty"))
+			return
+		}
+		valid := false
+		for _, p := range mount.Propagations {
+			valid = valid || p == propagation
+		}
+		if !valid {
+			c.setOptionError(errors.Errorf("unknown mount propagation %s", propagation))
+			return
+		}
+		c.mounts = append(c.mounts, mount.Mount{
+			Type:        mount.TypeBind,
+			Source:      source,
+			Target:      target,
+			BindOptions: &mount.BindOptions{Propagation: propagation},
+		})
+	}
+}
+
+// WithValidateMounts checks, before creating the container, that the host
+// source of every bind exists. Otherwise the daemon may silently bind an empty
+// directory. The source must be a directory when the target ends with a slash,
+// and have the type of the target when the image has it: targets are looked up
+// in a container created from the image for that purpose and never started.
+func WithValidateMounts() func(*Container) {
+	return func(c *Container) {
+		c.validateMounts = true
+	}
+}
+
+func (c *Container) checkMounts(ctx context.Context, cli *client.Client) error {
+	type bind struct {
+		source, target string
+		dir            bool
+	}
+	var binds []bind
+	for _, b := range c.BindHostConfig {
+		parts := strings.SplitN(b, ":", 3)
+		//Sources which are not paths are named volumes
+		if len(parts) < 2 || !filepath.IsAbs(parts[0]) {
+			continue
+		}
+		binds = append(binds, bind{source: parts[0], target: parts[1]})
+	}
+	for _, m := range c.mounts {
+		if m.Type == mount.TypeBind {
+			binds = append(binds, bind{source: m.Source, target: m.Target})
+		}
+	}
+
+	for i, b := range binds {
+		info, err := os.Stat(b.source)
+		if err != nil {
+			return errors.Wrapf(err, "invalid bind source for %s", b.target)
+		}
+		if strings.HasSuffix(b.target, "/") && !info.IsDir() {
+			return errors.Errorf("bind source %s must be a directory to be mounted on %s", b.source, b.target)
+		}
+		binds[i].dir = info.IsDir()
+	}
+	if len(binds) == 0 {
+		return nil
+	}
+
+	probe, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:      c.ImageToPull,
+		Entrypoint: []string{"true"},
+		Labels:     c.labels(),
+	}, nil, nil, nil, "")
+	if err != nil {
+		return errors.Wrap(err, "unable to create container to check mounts")
+	}
+	defer removeContainer(cli, probe.ID)
+	for _, b := range binds {
+		stat, err := cli.ContainerStatPath(ctx, probe.ID, path.Clean(b.target))
+		if client.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to check mount target %s", b.target)
+		}
+		//Symlinks are resolved when mounting, their target type is unknown here
+		if stat.Mode&os.ModeSymlink != 0 || stat.Mode.IsDir() == b.dir {
+			continue
+		}
+		if b.dir {
+			return errors.Errorf("bind source %s is a directory but %s is a file in the image", b.source, b.target)
+		}
+		return errors.Errorf("bind source %s is a file but %s is a directory in the image", b.source, b.target)
+	}
+	return nil
+}
+
+var containerName = regexp.MustCompile(`^/?[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// WithVolumesFrom mounts the volumes of another container, given by name or
+// ID, read-only if requested. It can be used several times.
+func WithVolumesFrom(container string, readOnly bool) func(*Container) {
+	return func(c *Container) {
+		if !containerName.MatchString(container) {
+			c.setOptionError(errors.Errorf("invalid container name %q", container))
+			return
+		}
+		if readOnly {
+			container += ":ro"
+		}
+		c.volumesFrom = append(c.volumesFrom, container)
+	}
+}
+
+// WithRemoveVolumes makes Stop remove the container's anonymous volumes and the
+// named volumes mounted with WithVolumeMount. Volumes are kept otherwise.
+func WithRemoveVolumes() func(*Container) {
+	return func(c *Container) {
+		c.removeVolumes = true
+	}
+}
+
+// EntrypointLogPath is where WithEntrypointWrapper keeps the entrypoint output inside the container.
+const EntrypointLogPath = "/tmp/docker-utils-entrypoint.log"
+
+// WithEntrypointWrapper runs the image entrypoint through a shell wrapper that
+// tees its output to EntrypointLogPath, so output of a container dying right
+// away can still be read with CopyFromContainer. The image must provide
+// /bin/sh; stderr is merged into stdout and signals are not forwarded.
+func WithEntrypointWrapper() func(*Container) {
+	return func(c *Container) {
+		c.entrypointWrapper = true
+	}
+}
+
+func WithMemorySwappiness(value int64) func(*Container) {
+	return func(c *Container) {
+		if value < 0 || value > 100 {
+			c.setOptionError(errors.Errorf("memory swappiness %d must be between 0 and 100", value))
+			return
+		}
+		c.resources.MemorySwappiness = &value
+	}
+}
+
+// WithRuntimeAnnotation passes an OCI annotation to the container runtime,
+// e.g: to tune Kata or gVisor. It needs docker API 1.43, it is dropped with a
+// warning when the daemon or the client only speak an older one.
+func WithRuntimeAnnotation(key, value string) func(*Container) {
+	return func(c *Container) {
+		if key == "" {
+			c.setOptionError(errors.New("annotation key cannot be empty"))
+			return
+		}
+		if c.annotations == nil {
+			c.annotations = map[string]string{}
+		}
+		c.annotations[key] = value
+	}
+}
+
+func WithLabel(key, value string) func(*Container) {
+	return func(c *Container) {
+		if c.userLabels == nil {
+			c.userLabels = map[string]string{}
+		}
+		c.userLabels[key] = value
+	}
+}
+
+func WithHostname(hostname string) func(*Container) {
+	return func(c *Container) {
+		c.Hostname = hostname
+	}
+}
+
+func WithDomainname(domainname string) func(*Container) {
+	return func(c *Container) {
+		c.Domainname = domainname
+	}
+}
+
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// WithFQDN splits fqdn into the container hostname and domain name, e.g:
+// "db.example.test" writes "db" to /etc/hostname and resolves
+// "db.example.test" through /etc/hosts.
+func WithFQDN(fqdn string) func(*Container) {
+	return func(c *Container) {
+		name := strings.TrimSuffix(fqdn, ".")
+		labels := strings.Split(name, ".")
+		if len(name) > 253 || len(labels) < 2 {
+			c.setOptionError(errors.Errorf("invalid FQDN %q", fqdn))
+			return
+		}
+		for _, label := range labels {
+			if !hostnameLabel.MatchString(label) {
+				c.setOptionError(errors.Errorf("invalid FQDN %q", fqdn))
+				return
+			}
+		}
+		c.Hostname = labels[0]
+		c.Domainname = strings.Join(labels[1:], ".")
+	}
+}
+
+// WithBlkioWeight sets the relative block IO weight of the container, from 10 to 1000.
+func WithBlkioWeight(weight uint16) func(*Container) {
+	return func(c *Container) {
+		if weight < 10 || weight > 1000 {
+			c.setOptionError(errors.Errorf("blkio weight %d must be between 10 and 1000", weight))
+			return
+		}
+		c.resources.BlkioWeight = weight
+	}
+}
+
+// WithSysctl sets a namespaced kernel parameter in the container. Docker only
+// accepts the ones living in a namespace the container does not share with the host:
+//   - net.* needs the container's own network namespace, so neither the host
+//     network nor another container's network;
+//   - kernel.msg*, kernel.sem, kernel.shm* and fs.mqueue.* need a private IPC namespace;
+//   - kernel.hostname and kernel.domainname are set with WithHostname and WithDomainname.
+func WithSysctl(key, value string) func(*Container) {
+	return func(c *Container) {
+		if key == "" {
+			c.setOptionError(errors.New("sysctl key cannot be empty"))
+			return
+		}
+		if c.sysctls == nil {
+			c.sysctls = map[string]string{}
+		}
+		c.sysctls[key] = value
+	}
+}
+
+func (c *Container) labels() map[string]string {
+	if c.noSessionLabel {
+		return c.userLabels
+	}
+	labels := map[string]string{SessionLabel: sessionID}
+	for key, value := range c.userLabels {
+		labels[key] = value
+	}
+	return labels
+}
+
+func (c *Container) validateSysctls() error {
+	mode := c.networkMode()
+	if !mode.IsHost() && !mode.IsContainer() {
+		return nil
+	}
+	for key := range c.sysctls {
+		if strings.HasPrefix(key, "net.") {
+			return errors.Errorf("sysctl %s needs a network namespace and cannot be used with the %s network mode", key, mode)
+		}
+	}
+	return nil
+}
+
+// WithSizeAccounting makes Inspect report the container's disk usage. Computing
+// it is expensive for the daemon, so it is off by default.
+func WithSizeAccounting() func(*Container) {
+	return func(c *Container) {
+		c.sizeAccounting = true
+	}
+}
+
+// WithRequestDump writes the create request sent to the daemon to w as JSON,
+// with the values of secret-looking environment variables and labels redacted.
+func WithRequestDump(w io.Writer) func(*Container) {
+	return func(c *Container) {
+		c.requestDump = w
+	}
+}
+
+// WithSecretFile writes a secret into the container as a 0400 file, like
+// WithFile. Unlike WithEnv, it is never part of the create request, so neither
+// WithRequestDump nor inspecting the container reveals it. The file belongs to
+// the user the container runs as, User or else the image USER.
+func WithSecretFile(containerPath string, content []byte) func(*Container) {
+	return WithFile(containerPath, content, 0400)
+}
+
 func WithEnv(env []string) func(*Container) {
 	return func(c *Container) {
 		c.Env = env
 	}
 }
 
+// WithHostUser runs the container process as the current host uid:gid, so files
+// written to bind mounts are owned by the invoking user. No-op on Windows.
+func WithHostUser() func(*Container) {
+	return func(c *Container) {
+		if runtime.GOOS == "windows" {
+			return
+		}
+		current, err := user.Current()
+		if err != nil {
+			c.setOptionError(errors.Wrap(err, "unable to get current user"))
+			return
+		}
+		c.User = current.Uid + ":" + current.Gid
+	}
+}
+
+// WithCmd sets the commands executed once the container is ready, it is the
+// same as WithPostReadyCmd.
 func WithCmd(cmd []string) func(*Container) {
 	return func(c *Container) {
 		c.Cmd = cmd
 	}
 }
 
+// WithPostStartCmd sets commands executed right after the container is
+// started, before waiting for it to be ready.
+func WithPostStartCmd(cmd []string) func(*Container) {
+	return func(c *Container) {
+		c.PostStartCmd = cmd
+	}
+}
+
+// WithPostReadyCmd sets commands executed once the container is ready, e.g: a
+// migration needing the database to accept connections.
+func WithPostReadyCmd(cmd []string) func(*Container) {
+	return func(c *Container) {
+		c.Cmd = cmd
+	}
+}
+
+func WithCmdTimeout(timeout time.Duration) func(*Container) {
+	return func(c *Container) {
+		c.CmdTimeout = timeout
+	}
+}
+
+// WithContainerLogsBufferSize caps how much command output and container logs
+// are buffered in memory. Only the last size bytes are kept when it is exceeded.
+func WithContainerLogsBufferSize(size int) func(*Container) {
+	return func(c *Container) {
+		c.LogsBufferSize = size
+	}
+}
+
+// WithExecTTY controls whether the commands executed in the container get a
+// TTY. It does not depend on the container's own TTY: without one, even in a
+// TTY container, the output is demultiplexed from the stream docker sends; with
+// one it is read as is. Either way stdout and stderr are logged together.
+func WithExecTTY(tty bool) func(*Container) {
+	return func(c *Container) {
+		c.ExecTTY = tty
+	}
+}
+
+const defaultDiagnosticLines = 50
+
+// WithDiagnosticLogLines sets how many trailing log lines are added to the
+// error of a readiness wait timing out, 50 by default. Zero leaves them out.
+func WithDiagnosticLogLines(n int) func(*Container) {
+	return func(c *Container) {
+		c.diagnosticLines = n
+	}
+}
+
 func WithSleep(sleepTime time.Duration) func(c *Container) {
 	return func(c *Container) {
 		c.Sleep = sleepTime
 	}
 }
 
+// WithRunTimeout kills the container if it is still running once the given
+// duration has elapsed since it was started. Docker has no native run timeout,
+// so the deadline is enforced by a goroutine which is released by Stop.
+func WithRunTimeout(timeout time.Duration) func(*Container) {
+	return func(c *Container) {
+		c.RunTimeout = timeout
+	}
+}
+
+// WithRestartPolicy sets when the daemon restarts the container: "always",
+// "unless-stopped" or "on-failure", the latter at most maxRetries times when not zero.
+func WithRestartPolicy(name string, maxRetries int) func(*Container) {
+	return func(c *Container) {
+		c.RestartPolicy = name
+		c.restartRetries = maxRetries
+	}
+}
+
+// WithStopTimeout sets how long Stop waits after the stop signal before the
+// daemon kills the container with SIGKILL. It is rounded up to the second.
+func WithStopTimeout(timeout time.Duration) func(*Container) {
+	return func(c *Container) {
+		c.StopTimeout = timeout
+	}
+}
+
+// WithNetwork attaches the container to an existing network. It can be used
+// several times; the first network is attached when the container is created
+// and the others are connected right before it is started. Swarm overlay
+// networks can be used as long as they were created attachable, see Network.
+//
+// When a container has several networks, Docker takes the default gateway from
+// the endpoints of non-internal networks, picking the one with the highest
+// gateway priority and, on a tie, the network whose name sorts first. The API
+// version used by this package does not expose that priority, so attachment
+// order alone does not decide the gateway: to force egress through a given
+// network, make the other ones internal or name them accordingly.
+func WithNetwork(name string, aliases ...string) func(*Container) {
+	return func(c *Container) {
+		c.networks = append(c.networks, networkAttachment{name: name, aliases: aliases})
+	}
+}
+
+// WithStaticIP gives the container a fixed IPv4 address on a network it joins
+// with WithNetwork. The network needs a user-defined subnet, see WithNetworkSubnet.
+func WithStaticIP(network, ip string) func(*Container) {
+	return func(c *Container) {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || parsed.To4() == nil {
+			c.setOptionError(errors.Errorf("invalid IPv4 address %s", ip))
+			return
+		}
+		if c.staticIPs == nil {
+			c.staticIPs = map[string]string{}
+		}
+		c.staticIPs[network] = ip
+	}
+}
+
+// WithMacAddress gives the container a fixed MAC address on a network it joins
+// with WithNetwork. Combined with WithStaticIP, both must target the same network.
+// A network other than the primary one needs docker API 1.44, on the daemon
+// and on the client alike.
+func WithMacAddress(network, mac string) func(*Container) {
+	return func(c *Container) {
+		if _, err := net.ParseMAC(mac); err != nil {
+			c.setOptionError(errors.Wrap(err, "invalid MAC address"))
+			return
+		}
+		if c.macAddresses == nil {
+			c.macAddresses = map[string]string{}
+		}
+		c.macAddresses[network] = mac
+	}
+}
+
+// WithPrimaryNetwork behaves like WithNetwork but makes the network the one
+// attached at create time, which also becomes the container's network mode.
+func WithPrimaryNetwork(name string, aliases ...string) func(*Container) {
+	return func(c *Container) {
+		c.networks = append([]networkAttachment{{name: name, aliases: aliases}}, c.networks...)
+	}
+}
+
 func NewContainer(imageToPull, containerPort string, options ...func(config *Container)) (*Container, error) {
 	if imageToPull == "" {
 		return nil, errors.New("imageToPull cannot be empty")
@@ -75,84 +694,854 @@ func NewContainer(imageToPull, containerPort string, options ...func(config *Con
 		return nil, errors.New("containerPort cannot be empty")
 	}
 
-	conf := &Container{
+	conf := defaultContainer(imageToPull)
+	conf.ContainerPort = containerPort
+	for _, opt := range options {
+		opt(conf)
+	}
+	if conf.optionErr != nil {
+		return nil, conf.optionErr
+	}
+	return conf, nil
+}
+
+// defaultContainer returns the configuration options are applied on.
+func defaultContainer(imageToPull string) *Container {
+	return &Container{
 		ImageToPull:       imageToPull,
+		HostIP:            "127.0.0.1",
 		HostPort:          "9876",
-		ContainerPort:     containerPort,
 		ContainerProtocol: "tcp",
+		LogsBufferSize:    defaultLogsBufferSize,
+		diagnosticLines:   defaultDiagnosticLines,
 	}
+}
+
+// Run runs cmd in a fresh container of image, like `docker run --rm image cmd`,
+// and returns its combined output and exit code. The image is only pulled when
+// missing locally. The container is removed whatever happens; port options are
+// ignored.
+func Run(ctx context.Context, image string, cmd []string, options ...func(*Container)) (string, int, error) {
+	if image == "" {
+		return "", 0, errors.New("image cannot be empty")
+	}
+
+	conf := defaultContainer(image)
+	conf.runCmd = cmd
 	for _, opt := range options {
 		opt(conf)
 	}
-	return conf, nil
+	if conf.optionErr != nil {
+		return "", 0, conf.optionErr
+	}
+	if err := conf.pullIfMissing(ctx); err != nil {
+		return "", 0, err
+	}
+
+	exitCode, output, err := conf.RunToCompletion(ctx)
+	return output, exitCode, err
+}
+
+// setOptionError keeps the first error raised by an option, NewContainer returns it
+func (c *Container) setOptionError(err error) {
+	if c.optionErr == nil {
+		c.optionErr = err
+	}
 }
 
 func (c *Container) CreateContainer() error {
-	//new docker API client
-	cli, err := client.NewClientWithOpts()
+	return c.createContainer(context.Background())
+}
+
+// Reset stops and removes the container, if any, then creates it again from
+// the same configuration with the same client. Nothing is recreated when the
+// current container could not be removed, its ID is kept to retry. Other
+// failures, e.g: removing its volumes, are returned once it is recreated.
+func (c *Container) Reset(ctx context.Context) error {
+	var errs []error
+	if c.id != "" {
+		var removed bool
+		if removed, errs = c.stopAndRemove(); !removed {
+			return joinErrors(errs)
+		}
+		c.id = ""
+	}
+	if err := c.createContainer(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return joinErrors(errs)
+	}
+	return nil
+}
+
+func (c *Container) createContainer(ctx context.Context) error {
+	cli, err := c.dockerClient()
+	if err != nil {
+		return err
+	}
+	portBinding, err := c.portBindings()
+	if err != nil {
+		return err
+	}
+
+	if !c.imagePulled {
+		if err = c.pullImage(ctx, cli); err != nil {
+			return err
+		}
+	}
+
+	id, err := c.create(ctx, cli, portBinding)
 	if err != nil {
-		return errors.Wrap(err, "unable to create docker client")
+		return err
+	}
+
+	if err = c.start(ctx, cli, id); err != nil {
+		c.cancelRunTimeout()
+		removeContainer(cli, id)
+		return err
+	}
+
+	c.id = id
+
+	return nil
+}
+
+func (c *Container) start(ctx context.Context, cli *client.Client, id string) error {
+	err := cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+	if err != nil {
+		return errors.Wrap(err, "unable to start container")
+	}
+	if c.RunTimeout > 0 {
+		c.stopRunTimeout = watchRunTimeout(cli, id, c.RunTimeout)
+	}
+	if c.logStream != nil {
+		go streamLogs(cli, id, c.logStream, c.logPrefix)
+	}
+
+	if err = c.executeCommands(ctx, cli, id, c.PostStartCmd); err != nil {
+		return errors.Wrap(err, "post start commands were not executed")
+	}
+
+	time.Sleep(c.Sleep)
+	if c.portWait > 0 {
+		resolve := func(ctx context.Context) (string, error) {
+			return c.publishedAddress(ctx, cli, id)
+		}
+		if err = waitForPort(ctx, c.portWait, resolve); err != nil {
+			return c.readinessError(cli, id, err)
+		}
+	}
+	if c.logWait != nil {
+		if err = waitForLog(ctx, cli, id, c.logWait, c.restartTolerance); err != nil {
+			return c.readinessError(cli, id, err)
+		}
+	}
+
+	if err = c.executeCommands(ctx, cli, id, c.Cmd); err != nil {
+		return errors.Wrap(err, "commands were not executed")
+	}
+	return nil
+}
+
+// readinessError adds the last lines of the container logs to a readiness failure.
+func (c *Container) readinessError(cli *client.Client, id string, err error) error {
+	if c.diagnosticLines <= 0 {
+		return errors.Wrap(err, "container is not ready")
+	}
+	logs, logsErr := containerLogs(context.Background(), cli, id, c.LogsBufferSize, strconv.Itoa(c.diagnosticLines))
+	if logsErr != nil || logs == "" {
+		return errors.Wrap(err, "container is not ready")
 	}
+	return errors.Errorf("container is not ready: %v\nlast %d log lines:\n%s", err, c.diagnosticLines, logs)
+}
+
+// RunToCompletion runs the container as a one-shot job: it is created without
+// port bindings, started, waited for until it exits and then removed. The exit
+// code and the combined stdout/stderr logs are returned.
+func (c *Container) RunToCompletion(ctx context.Context) (int, string, error) {
+	cli, err := c.dockerClient()
+	if err != nil {
+		return 0, "", err
+	}
+
+	if !c.imagePulled {
+		if err = c.pullImage(ctx, cli); err != nil {
+			return 0, "", err
+		}
+	}
+
+	id, err := c.create(ctx, cli, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer removeContainer(cli, id)
+
+	statusCh, errCh := cli.ContainerWait(ctx, id, container.WaitConditionNextExit)
+	if err = cli.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		return 0, "", errors.Wrap(err, "unable to start container")
+	}
+	if c.RunTimeout > 0 {
+		stopRunTimeout := watchRunTimeout(cli, id, c.RunTimeout)
+		defer stopRunTimeout()
+	}
+
+	statusCode, err := waitResult(statusCh, errCh)
+	if err != nil {
+		return 0, "", err
+	}
+	exitCode := int(statusCode)
+
+	logs, err := containerLogs(ctx, cli, id, c.LogsBufferSize, "")
+	if err != nil {
+		return exitCode, "", err
+	}
+	return exitCode, logs, nil
+}
+
+// ID returns the container ID, empty until the container is created.
+func (c *Container) ID() string {
+	return c.id
+}
+
+// ShortID returns the first 12 characters of the container ID, as displayed by the docker CLI.
+func (c *Container) ShortID() string {
+	return shortID(c.id)
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// CreateWarnings returns the warnings the daemon reported when creating the
+// container, e.g: about options it discarded.
+func (c *Container) CreateWarnings() []string {
+	return c.createWarnings
+}
+
+func (c *Container) portBindings() (nat.PortMap, error) {
+	if c.noPortBindings {
+		if c.portOptions {
+			log.Println("port bindings are ignored, they were disabled with WithoutPortBindings")
+		}
+		return nil, nil
+	}
+	if mode := c.networkMode(); mode.IsHost() || mode.IsNone() || mode.IsContainer() {
+		if c.portOptions {
+			log.Printf("port bindings are ignored in %s network mode", mode)
+		}
+		return nil, nil
+	}
+
 	//Mapping ports
 	hostBinding := nat.PortBinding{
-		HostIP:   "127.0.0.1",
+		HostIP:   c.HostIP,
 		HostPort: c.HostPort,
 	}
 	containerPort, err := nat.NewPort(c.ContainerProtocol, c.ContainerPort)
 	if err != nil {
-		return errors.Wrap(err, "unable to get port")
+		return nil, errors.Wrap(err, "unable to get port")
 	}
 	portBinding := nat.PortMap{containerPort: []nat.PortBinding{hostBinding}}
+	for _, port := range c.extraPorts {
+		//The container port keeps its own binding to HostPort
+		if port == containerPort {
+			continue
+		}
+		portBinding[port] = []nat.PortBinding{{HostIP: hostBinding.HostIP, HostPort: port.Port()}}
+	}
+	return portBinding, nil
+}
+
+func (c *Container) networkMode() container.NetworkMode {
+	if len(c.networks) == 0 {
+		return ""
+	}
+	return container.NetworkMode(c.networks[0].name)
+}
+
+// ServerVersion returns the version information of the docker daemon.
+func (c *Container) ServerVersion(ctx context.Context) (types.Version, error) {
+	cli, err := c.dockerClient()
+	if err != nil {
+		return types.Version{}, err
+	}
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return types.Version{}, errors.Wrap(err, "unable to get server version")
+	}
+	return version, nil
+}
+
+func (c *Container) dockerClient() (*client.Client, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
+	//new docker API client, downgrading its API version to the daemon's when older
+	cli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create docker client")
+	}
+	c.client = cli
+	return cli, nil
+}
+
+// apiRequirement ties an option to the minimum docker API version able to honor it.
+type apiRequirement struct {
+	option  string
+	version string
+	inUse   func(c *Container) bool
+	drop    func(c *Container) // When set, the option is dropped with a warning instead of failing
+}
+
+// apiRequirements lists the options the daemon would silently drop when its API is too old.
+var apiRequirements = []apiRequirement{
+	{
+		option:  "WithRuntimeAnnotation",
+		version: "1.43",
+		inUse:   func(c *Container) bool { return len(c.annotations) > 0 },
+		drop:    func(c *Container) { c.annotations = nil },
+	},
+	{
+		option:  "WithMacAddress on a secondary network",
+		version: "1.44",
+		inUse: func(c *Container) bool {
+			for name := range c.macAddresses {
+				if len(c.networks) > 0 && name != c.networks[0].name {
+					return true
+				}
+			}
+			return false
+		},
+	},
+}
+
+// checkAPIVersion compares the requirements to the API version requests are
+// actually sent with, the oldest of the client's and the daemon's.
+func (c *Container) checkAPIVersion(ctx context.Context, cli *client.Client) error {
+	var apiVersion string
+	for _, req := range apiRequirements {
+		if !req.inUse(c) {
+			continue
+		}
+		if apiVersion == "" {
+			version, err := cli.ServerVersion(ctx)
+			if err != nil {
+				return errors.Wrap(err, "unable to get server version")
+			}
+			apiVersion = version.APIVersion
+			if clientVersion := cli.ClientVersion(); versions.LessThan(clientVersion, apiVersion) {
+				apiVersion = clientVersion
+			}
+		}
+		if !versions.LessThan(apiVersion, req.version) {
+			continue
+		}
+		if req.drop == nil {
+			return errors.Errorf("%s requires docker API %s or newer, only %s is available", req.option, req.version, apiVersion)
+		}
+		log.Printf("%s is ignored, it requires docker API %s or newer and only %s is available", req.option, req.version, apiVersion)
+		req.drop(c)
+	}
+	return nil
+}
+
+// prefetchImage pulls the image ahead of CreateContainer, which then skips the pull.
+func (c *Container) prefetchImage(ctx context.Context) error {
+	cli, err := c.dockerClient()
+	if err != nil {
+		return err
+	}
+	if err = c.pullImage(ctx, cli); err != nil {
+		return err
+	}
+	c.imagePulled = true
+	return nil
+}
 
-	ctx := context.Background()
+// pullIfMissing pulls the image unless it already exists locally, e.g: built
+// by a previous step. CreateContainer and RunToCompletion then skip the pull.
+func (c *Container) pullIfMissing(ctx context.Context) error {
+	cli, err := c.dockerClient()
+	if err != nil {
+		return err
+	}
+	_, _, err = cli.ImageInspectWithRaw(ctx, c.ImageToPull)
+	switch {
+	case err == nil:
+	case client.IsErrNotFound(err):
+		if err = c.pullImage(ctx, cli); err != nil {
+			return err
+		}
+	default:
+		return errors.Wrap(err, "unable to inspect image")
+	}
+	c.imagePulled = true
+	return nil
+}
+
+var imageID = regexp.MustCompile(`^(sha256:)?[a-f0-9]{64}$`)
+
+func (c *Container) pullImage(ctx context.Context, cli *client.Client) error {
+	//An image ID can't be pulled, it has to exist locally, e.g: built by a previous step
+	if imageID.MatchString(c.ImageToPull) {
+		if _, _, err := cli.ImageInspectWithRaw(ctx, c.ImageToPull); err != nil {
+			return errors.Wrapf(err, "image %s not found locally", c.ImageToPull)
+		}
+		return nil
+	}
+
+	var options types.ImagePullOptions
+	if c.dockerConfigAuth {
+		auth, err := registryAuthFromConfig(c.ImageToPull)
+		if err != nil {
+			return err
+		}
+		options.RegistryAuth = auth
+	}
 	//Pulling imageToPull...
-	_, err = cli.ImagePull(ctx, c.ImageToPull, types.ImagePullOptions{})
+	return pull(ctx, cli, c.ImageToPull, options)
+}
+
+func pull(ctx context.Context, cli *client.Client, ref string, options types.ImagePullOptions) error {
+	reader, err := cli.ImagePull(ctx, ref, options)
 	if err != nil {
 		return errors.Wrap(err, "unable to pull image")
 	}
+	defer reader.Close()
+
+	//The pull is only over once its progress stream has been consumed, errors are reported in it
+	if err = jsonmessage.DisplayJSONMessagesStream(reader, ioutil.Discard, 0, false, nil); err != nil {
+		return errors.Wrap(err, "unable to pull image")
+	}
+	return nil
+}
 
-	cont, err := cli.ContainerCreate(
-		context.Background(),
-		&container.Config{
-			AttachStdout: true,
-			AttachStderr: true,
-			Env:          c.Env,
-			Image:        c.ImageToPull,
+func (c *Container) create(ctx context.Context, cli *client.Client, portBinding nat.PortMap) (string, error) {
+	if err := c.checkAPIVersion(ctx, cli); err != nil {
+		return "", err
+	}
+	if err := c.validateSysctls(); err != nil {
+		return "", err
+	}
+	if err := c.validateStaticIPs(ctx, cli); err != nil {
+		return "", err
+	}
+	if err := c.validateMacAddresses(); err != nil {
+		return "", err
+	}
+	if c.validateMounts {
+		if err := c.checkMounts(ctx, cli); err != nil {
+			return "", err
+		}
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: portBinding,
+		Binds:        c.BindHostConfig,
+		SecurityOpt:  c.SecurityOpt,
+		Mounts:       c.mounts,
+		Resources:    c.resources,
+		Annotations:  c.annotations,
+		Sysctls:      c.sysctls,
+		VolumesFrom:  c.volumesFrom,
+		RestartPolicy: container.RestartPolicy{
+			Name:              c.RestartPolicy,
+			MaximumRetryCount: c.restartRetries,
 		},
-		&container.HostConfig{
-			PortBindings: portBinding,
-			Binds:        c.BindHostConfig,
-		}, nil, nil, "")
+	}
+	var networkingConfig *network.NetworkingConfig
+	if len(c.networks) > 0 {
+		primary := c.networks[0]
+		hostConfig.NetworkMode = c.networkMode()
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				primary.name: c.endpointSettings(primary),
+			},
+		}
+	}
+
+	config := &container.Config{
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          c.Env,
+		Image:        c.ImageToPull,
+		User:         c.User,
+		Hostname:     c.Hostname,
+		Domainname:   c.Domainname,
+		Labels:       c.labels(),
+		Cmd:          c.runCmd,
+	}
+	if len(c.networks) > 0 {
+		//Older daemons only read the MAC address of the primary network from here
+		config.MacAddress = c.macAddresses[c.networks[0].name]
+	}
+	if c.entrypointWrapper {
+		if err := wrapEntrypoint(ctx, cli, config); err != nil {
+			return "", err
+		}
+	}
+
+	if c.requestDump != nil {
+		dumpRequest(c.requestDump, config, hostConfig, networkingConfig)
+	}
+
+	cont, err := cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, "")
 
 	if err != nil {
-		return errors.Wrap(err, "unable to create container")
+		return "", errors.Wrap(err, "unable to create container")
+	}
+	c.createWarnings = cont.Warnings
+	for _, warning := range cont.Warnings {
+		log.Printf("container created with warning: %s", warning)
+	}
+
+	if err = c.connectNetworks(ctx, cli, cont.ID); err != nil {
+		removeContainer(cli, cont.ID)
+		return "", err
 	}
 
-	err = cli.ContainerStart(ctx, cont.ID, types.ContainerStartOptions{})
+	if err = copyFiles(ctx, cli, cont.ID, c.files); err != nil {
+		removeContainer(cli, cont.ID)
+		return "", err
+	}
+
+	return cont.ID, nil
+}
+
+// Inspect returns the daemon's view of the container. SizeRw and SizeRootFs are
+// only filled with WithSizeAccounting.
+func (c *Container) Inspect(ctx context.Context) (types.ContainerJSON, error) {
+	if c.id == "" {
+		return types.ContainerJSON{}, errors.New("container is not created")
+	}
+	info, _, err := c.client.ContainerInspectWithRaw(ctx, c.id, c.sizeAccounting)
 	if err != nil {
-		return errors.Wrap(err, "unable to start container")
+		return types.ContainerJSON{}, errors.Wrap(err, "unable to inspect container")
 	}
+	return info, nil
+}
 
-	time.Sleep(c.Sleep)
+// EffectiveConfig returns the configuration the container actually runs with,
+// once every option and daemon default was applied.
+func (c *Container) EffectiveConfig(ctx context.Context) (*container.Config, *container.HostConfig, error) {
+	if c.id == "" {
+		return nil, nil, errors.New("container is not created")
+	}
+	info, err := c.client.ContainerInspect(ctx, c.id)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to inspect container")
+	}
+	return info.Config, info.HostConfig, nil
+}
 
-	if err = executeCommands(ctx, cli, cont.ID, c.Cmd); err != nil {
-		return errors.Wrap(err, "commands were not executed")
+// Timestamps returns when the daemon created and last started the container.
+func (c *Container) Timestamps(ctx context.Context) (created, started time.Time, err error) {
+	if c.id == "" {
+		return time.Time{}, time.Time{}, errors.New("container is not created")
+	}
+	info, err := c.client.ContainerInspect(ctx, c.id)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrap(err, "unable to inspect container")
 	}
+	if created, err = time.Parse(time.RFC3339Nano, info.Created); err != nil {
+		return time.Time{}, time.Time{}, errors.Wrap(err, "unable to parse creation time")
+	}
+	if started, err = time.Parse(time.RFC3339Nano, info.State.StartedAt); err != nil {
+		return time.Time{}, time.Time{}, errors.Wrap(err, "unable to parse start time")
+	}
+	return created, started, nil
+}
 
-	c.id = cont.ID
-	c.client = cli
+// CopyFromContainer reads a single file from the container, stopped or not.
+func (c *Container) CopyFromContainer(ctx context.Context, containerPath string) ([]byte, error) {
+	if c.id == "" {
+		return nil, errors.New("container is not created")
+	}
+	reader, _, err := c.client.CopyFromContainer(ctx, c.id, containerPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to copy from container")
+	}
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.Errorf("%s is not a file", containerPath)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read archive from container")
+		}
+		if header.Typeflag == tar.TypeReg {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to read archive from container")
+			}
+			return data, nil
+		}
+	}
+}
+
+func (c *Container) wait(ctx context.Context) (int64, error) {
+	if c.id == "" {
+		return 0, errors.New("container is not created")
+	}
+	return waitResult(c.client.ContainerWait(ctx, c.id, container.WaitConditionNotRunning))
+}
+
+func waitResult(statusCh <-chan container.WaitResponse, errCh <-chan error) (int64, error) {
+	select {
+	case err := <-errCh:
+		return 0, errors.Wrap(err, "unable to wait for container")
+	case status := <-statusCh:
+		if status.Error != nil {
+			return 0, errors.Errorf("unable to wait for container: %s", status.Error.Message)
+		}
+		return status.StatusCode, nil
+	}
+}
+
+// containerLogs returns the combined stdout and stderr logs, only the tail last lines of them unless empty.
+func containerLogs(ctx context.Context, cli *client.Client, id string, bufferSize int, tail string) (string, error) {
+	reader, err := cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Tail: tail})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get container logs")
+	}
+	defer reader.Close()
+
+	logs := newTailBuffer(bufferSize)
+	if _, err = stdcopy.StdCopy(logs, logs, reader); err != nil {
+		return "", errors.Wrap(err, "unable to read container logs")
+	}
+	return logs.String(), nil
+}
+
+const entrypointWrapperScript = `{ "$@"; echo $? > /tmp/.docker-utils-exit; } 2>&1 | tee ` + EntrypointLogPath + `; exit "$(cat /tmp/.docker-utils-exit)"`
+
+func wrapEntrypoint(ctx context.Context, cli *client.Client, config *container.Config) error {
+	image, _, err := cli.ImageInspectWithRaw(ctx, config.Image)
+	if err != nil {
+		return errors.Wrap(err, "unable to inspect image")
+	}
+	var original []string
+	if image.Config != nil {
+		cmd := image.Config.Cmd
+		if len(config.Cmd) > 0 {
+			cmd = config.Cmd
+		}
+		original = append(append(original, image.Config.Entrypoint...), cmd...)
+	}
+	if len(original) == 0 {
+		return errors.New("image has no entrypoint or command to wrap")
+	}
+	config.Entrypoint = []string{"/bin/sh", "-c", entrypointWrapperScript, "docker-utils-wrapper"}
+	config.Cmd = original
+	return nil
+}
+
+func (c *Container) connectNetworks(ctx context.Context, cli *client.Client, id string) error {
+	if len(c.networks) < 2 {
+		return nil
+	}
+	for _, n := range c.networks[1:] {
+		err := cli.NetworkConnect(ctx, n.name, id, c.endpointSettings(n))
+		if err != nil {
+			return errors.Wrapf(err, "unable to connect container to network %s", n.name)
+		}
+	}
+	return nil
+}
+
+func (c *Container) endpointSettings(n networkAttachment) *network.EndpointSettings {
+	settings := &network.EndpointSettings{Aliases: n.aliases}
+	if ip, ok := c.staticIPs[n.name]; ok {
+		settings.IPAMConfig = &network.EndpointIPAMConfig{IPv4Address: ip}
+	}
+	settings.MacAddress = c.macAddresses[n.name]
+	return settings
+}
 
+func (c *Container) joins(name string) bool {
+	for _, n := range c.networks {
+		if n.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Container) validateMacAddresses() error {
+	for name, mac := range c.macAddresses {
+		if !c.joins(name) {
+			return errors.Errorf("MAC address %s targets network %s the container does not join", mac, name)
+		}
+		if _, ok := c.staticIPs[name]; len(c.staticIPs) > 0 && !ok {
+			return errors.Errorf("MAC address %s and static IP must target the same network", mac)
+		}
+	}
+	return nil
+}
+
+// validateStaticIPs checks every static IP targets a network the container joins, within its subnets when they are known
+func (c *Container) validateStaticIPs(ctx context.Context, cli *client.Client) error {
+	for name, ip := range c.staticIPs {
+		if !c.joins(name) {
+			return errors.Errorf("static IP %s targets network %s the container does not join", ip, name)
+		}
+
+		resource, err := cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "unable to inspect network %s", name)
+		}
+		if len(resource.IPAM.Config) == 0 {
+			continue
+		}
+		inSubnet := false
+		for _, cfg := range resource.IPAM.Config {
+			if _, subnet, err := net.ParseCIDR(cfg.Subnet); err == nil && subnet.Contains(net.ParseIP(ip)) {
+				inSubnet = true
+			}
+		}
+		if !inSubnet {
+			return errors.Errorf("static IP %s is not in the subnets of network %s", ip, name)
+		}
+	}
 	return nil
 }
 
-func executeCommands(ctx context.Context, cli *client.Client, id string, cmd []string) error {
+var secretKeys = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "AUTH"}
+
+func isSecretKey(key string) bool {
+	key = strings.ToUpper(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func dumpRequest(w io.Writer, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig) {
+	redacted := *config
+	redacted.Env = make([]string, len(config.Env))
+	for i, env := range config.Env {
+		key := strings.SplitN(env, "=", 2)[0]
+		if isSecretKey(key) {
+			env = key + "=<redacted>"
+		}
+		redacted.Env[i] = env
+	}
+	if config.Labels != nil {
+		redacted.Labels = make(map[string]string, len(config.Labels))
+		for key, value := range config.Labels {
+			if isSecretKey(key) {
+				value = "<redacted>"
+			}
+			redacted.Labels[key] = value
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(struct {
+		Config           *container.Config
+		HostConfig       *container.HostConfig
+		NetworkingConfig *network.NetworkingConfig
+	}{&redacted, hostConfig, networkingConfig})
+	if err != nil {
+		log.Printf("unable to dump create request: %v", err)
+	}
+}
+
+func watchRunTimeout(cli *client.Client, id string, timeout time.Duration) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		statusCh, errCh := cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+		select {
+		case <-ctx.Done():
+		case <-statusCh:
+		case err := <-errCh:
+			//Cancelling ctx also ends the wait with an error, only other failures lose the timeout
+			if ctx.Err() == nil {
+				log.Printf("run timeout of container %s is not enforced, unable to wait for it: %v", shortID(id), err)
+			}
+		case <-timer.C:
+			log.Printf("container %s exceeded its run timeout of %s, killing it", id, timeout)
+			if err := cli.ContainerKill(context.Background(), id, "SIGKILL"); err != nil {
+				log.Printf("unable to kill container: %v", err)
+			}
+		}
+	}()
+	return cancel
+}
+
+func copyFiles(ctx context.Context, cli *client.Client, id string, files []containerFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, f := range files {
+		header := &tar.Header{
+			Name:    strings.TrimPrefix(f.path, "/"),
+			Mode:    int64(f.mode.Perm()),
+			Size:    int64(len(f.content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Wrapf(err, "unable to archive file %s", f.path)
+		}
+		if _, err := tw.Write(f.content); err != nil {
+			return errors.Wrapf(err, "unable to archive file %s", f.path)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "unable to archive files")
+	}
+
+	//The daemon gives the files to the user the container runs as, so it can read them whatever their mode
+	options := types.CopyToContainerOptions{CopyUIDGID: true}
+	if err := cli.CopyToContainer(ctx, id, "/", &archive, options); err != nil {
+		return errors.Wrap(err, "unable to copy files to container")
+	}
+	return nil
+}
+
+func removeContainer(cli *client.Client, id string) {
+	err := cli.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		log.Printf("unable to remove container: %v", err)
+	}
+}
+
+// execClient is the part of the docker client used to execute commands in a container.
+type execClient interface {
+	ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error)
+	ContainerExecStart(ctx context.Context, execID string, config types.ExecStartCheck) error
+}
+
+func (c *Container) executeCommands(ctx context.Context, cli execClient, id string, cmd []string) error {
 	if cmd == nil {
 		return nil
 	}
+	if c.CmdTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CmdTimeout)
+		defer cancel()
+	}
 
 	execConfig := types.ExecConfig{
 		AttachStdout: true,
 		AttachStderr: true,
+		Tty:          c.ExecTTY,
 		Cmd:          cmd,
 	}
 	execID, err := cli.ContainerExecCreate(ctx, id, execConfig)
@@ -161,27 +1550,171 @@ func executeCommands(ctx context.Context, cli *client.Client, id string, cmd []s
 	}
 
 	//Attaching connection to get exec logs
-	response, err := cli.ContainerExecAttach(context.Background(), execID.ID, types.ExecStartCheck{})
+	response, err := cli.ContainerExecAttach(ctx, execID.ID, types.ExecStartCheck{Tty: c.ExecTTY})
 	if err != nil {
 		return errors.Wrap(err, "unable to attach connection")
 	}
 	defer response.Close()
 
-	if err = cli.ContainerExecStart(ctx, execID.ID, types.ExecStartCheck{}); err != nil {
+	if err = cli.ContainerExecStart(ctx, execID.ID, types.ExecStartCheck{Tty: c.ExecTTY}); err != nil {
 		return errors.Wrap(err, "unable to start exec")
 	}
 
-	data, _ := ioutil.ReadAll(response.Reader)
-	log.Println(string(data))
-	return nil
+	output := make(chan string, 1)
+	go func() {
+		data := newTailBuffer(c.LogsBufferSize)
+		if c.ExecTTY {
+			_, _ = io.Copy(data, response.Reader)
+		} else {
+			//Without a TTY stdout and stderr are multiplexed in the same stream
+			_, _ = stdcopy.StdCopy(data, data, response.Reader)
+		}
+		output <- data.String()
+	}()
+
+	select {
+	case data := <-output:
+		log.Println(data)
+		return nil
+	case <-ctx.Done():
+		//Docker cannot kill an exec, closing the attached connection is all we can do
+		response.Close()
+		return errors.Wrapf(ctx.Err(), "command %v did not finish in time", cmd)
+	}
+}
+
+const defaultLogsBufferSize = 4 << 20
+
+// tailBuffer is an io.Writer keeping only the last size bytes written to it.
+// It grows up to twice its size before dropping older bytes, so each byte is
+// moved a bounded number of times however small the writes are.
+type tailBuffer struct {
+	size      int
+	buf       []byte
+	truncated bool
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	if size <= 0 {
+		size = defaultLogsBufferSize
+	}
+	return &tailBuffer{size: size}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if n > b.size {
+		p = p[n-b.size:]
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.size {
+		b.truncated = true
+	}
+	if len(b.buf) >= 2*b.size {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.size:]...)
+	}
+	return n, nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return fmt.Sprintf("[output truncated to its last %d bytes]\n%s", b.size, b.buf[len(b.buf)-b.size:])
+	}
+	return string(b.buf)
+}
+
+func (c *Container) cancelRunTimeout() {
+	if c.stopRunTimeout != nil {
+		c.stopRunTimeout()
+		c.stopRunTimeout = nil
+	}
 }
 
 func (c *Container) Stop() {
-	if err := c.client.ContainerStop(context.Background(), c.id, container.StopOptions{}); err != nil {
-		log.Printf("unable to stop container: %v", err)
+	for _, err := range c.stop() {
+		log.Println(err)
+	}
+}
+
+const (
+	removalTimeout      = 30 * time.Second
+	removalPollInterval = 200 * time.Millisecond
+)
+
+// StopAndWait stops and removes the container like Stop, then waits until the
+// daemon no longer knows about it, for at most 30s unless ctx ends earlier.
+func (c *Container) StopAndWait(ctx context.Context) error {
+	if c.id == "" {
+		return errors.New("container is not created")
+	}
+	id := c.id
+	if errs := c.stop(); len(errs) > 0 {
+		return joinErrors(errs)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, removalTimeout)
+	defer cancel()
+	ticker := time.NewTicker(removalPollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := c.client.ContainerInspect(ctx, id)
+		if client.IsErrNotFound(err) {
+			c.id = ""
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("container %s still exists after being removed", shortID(id))
+		case <-ticker.C:
+		}
 	}
-	err := c.client.ContainerRemove(context.Background(), c.id, types.ContainerRemoveOptions{})
+}
+
+func joinErrors(errs []error) error {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// stop stops and removes the container, going on after failures which are all returned.
+func (c *Container) stop() []error {
+	_, errs := c.stopAndRemove()
+	return errs
+}
+
+// stopAndRemove behaves like stop and also tells whether the container was removed.
+func (c *Container) stopAndRemove() (bool, []error) {
+	if c.id == "" {
+		return false, nil
+	}
+	c.cancelRunTimeout()
+
+	var errs []error
+	var options container.StopOptions
+	if c.StopTimeout > 0 {
+		seconds := int((c.StopTimeout + time.Second - 1) / time.Second)
+		options.Timeout = &seconds
+	}
+	if err := c.client.ContainerStop(context.Background(), c.id, options); err != nil {
+		errs = append(errs, errors.Wrap(err, "unable to stop container"))
+	}
+	err := c.client.ContainerRemove(context.Background(), c.id, types.ContainerRemoveOptions{RemoveVolumes: c.removeVolumes})
 	if err != nil {
-		log.Printf("unable to remove container: %v", err)
+		return false, append(errs, errors.Wrap(err, "unable to remove container"))
+	}
+	if !c.removeVolumes {
+		return true, errs
+	}
+	for _, m := range c.mounts {
+		if m.Type != mount.TypeVolume {
+			continue
+		}
+		if err = c.client.VolumeRemove(context.Background(), m.Source, false); err != nil {
+			errs = append(errs, errors.Wrapf(err, "unable to remove volume %s", m.Source))
+		}
 	}
+	return true, errs
 }
@@ -0,0 +1,291 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testImage = "alpine:3.18"
+
+// requireDocker skips integration tests in short mode or when no daemon answers.
+func requireDocker(t testing.TB) *client.Client {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration test skipped in short mode")
+	}
+	cli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+	if err == nil {
+		_, err = cli.Ping(context.Background())
+	}
+	if err != nil {
+		t.Skipf("docker daemon not available: %v", err)
+	}
+	return cli
+}
+
+// testName returns a name unique to the test run, for volumes and networks.
+func testName(t testing.TB) string {
+	return "docker-utils-" + strings.ToLower(t.Name()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// withTestCmd overrides the image command, as Run does.
+func withTestCmd(cmd ...string) func(*Container) {
+	return func(c *Container) {
+		c.runCmd = cmd
+	}
+}
+
+// sleeper returns a container doing nothing until it is stopped.
+func sleeper(t testing.TB, options ...func(*Container)) *Container {
+	t.Helper()
+	options = append([]func(*Container){withTestCmd("sleep", "300"), WithoutPortBindings(), WithStopTimeout(time.Second)}, options...)
+	c, err := NewContainer(testImage, "80", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// hungExec is an execClient whose commands never write any output.
+type hungExec struct {
+	server net.Conn
+}
+
+func (e *hungExec) ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error) {
+	return types.IDResponse{ID: "exec"}, nil
+}
+
+func (e *hungExec) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	var conn net.Conn
+	conn, e.server = net.Pipe()
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(conn)}, nil
+}
+
+func (e *hungExec) ContainerExecStart(ctx context.Context, execID string, config types.ExecStartCheck) error {
+	return nil
+}
+
+func TestExecuteCommandsTimeout(t *testing.T) {
+	exec := &hungExec{}
+	c := &Container{CmdTimeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	err := c.executeCommands(context.Background(), exec, "container", []string{"sleep", "infinity"})
+	elapsed := time.Since(start)
+
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("command timed out after %s, expected about %s", elapsed, c.CmdTimeout)
+	}
+	//The attached connection is closed so the output reader is released
+	if _, err = exec.server.Write([]byte("late output")); err == nil {
+		t.Fatal("attached connection is still open")
+	}
+}
+
+func TestTailBufferKeepsLastBytes(t *testing.T) {
+	b := newTailBuffer(10)
+	for i := 0; i < 100; i++ {
+		_, _ = b.Write([]byte{byte('0' + i%10)})
+	}
+	if got := b.String(); !strings.HasSuffix(got, "\n0123456789") || !strings.HasPrefix(got, "[output truncated") {
+		t.Fatalf("unexpected buffer content %q", got)
+	}
+	if len(b.buf) >= 2*b.size {
+		t.Fatalf("buffer grew to %d bytes", len(b.buf))
+	}
+
+	b = newTailBuffer(4)
+	_, _ = b.Write([]byte("abcdefgh"))
+	if got := b.String(); !strings.HasSuffix(got, "\nefgh") {
+		t.Fatalf("unexpected buffer content %q", got)
+	}
+}
+
+func TestVolumeMountPersistsAcrossContainers(t *testing.T) {
+	cli := requireDocker(t)
+	ctx := context.Background()
+	volume := testName(t)
+	defer cli.VolumeRemove(ctx, volume, true)
+
+	writer := sleeper(t, WithVolumeMount(volume, "/data"), WithPostStartCmd([]string{"sh", "-c", "echo persisted > /data/value"}))
+	if err := writer.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+	if errs := writer.stop(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if _, err := cli.VolumeInspect(ctx, volume); err != nil {
+		t.Fatalf("volume did not survive stop: %v", err)
+	}
+
+	output, exitCode, err := Run(ctx, testImage, []string{"cat", "/data/value"}, WithVolumeMount(volume, "/data"))
+	if err != nil || exitCode != 0 {
+		t.Fatalf("unable to read volume, exit code %d: %v", exitCode, err)
+	}
+	if strings.TrimSpace(output) != "persisted" {
+		t.Fatalf("expected the value written by the first container, got %q", output)
+	}
+
+	remover := sleeper(t, WithVolumeMount(volume, "/data"), WithRemoveVolumes())
+	if err = remover.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+	if errs := remover.stop(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if _, err = cli.VolumeInspect(ctx, volume); !client.IsErrNotFound(err) {
+		t.Fatalf("volume still exists with WithRemoveVolumes: %v", err)
+	}
+}
+
+func TestStopKillsContainerIgnoringSIGTERM(t *testing.T) {
+	cli := requireDocker(t)
+	const timeout = 2 * time.Second
+	c := sleeper(t, withTestCmd("sh", "-c", "trap '' TERM; sleep 300"), WithStopTimeout(timeout))
+	if err := c.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+	id := c.ID()
+
+	start := time.Now()
+	if errs := c.stop(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	elapsed := time.Since(start)
+
+	//The daemon waits the whole timeout since SIGTERM is ignored, then kills
+	if elapsed < timeout-200*time.Millisecond || elapsed > timeout+5*time.Second {
+		t.Fatalf("stop took %s with a stop timeout of %s", elapsed, timeout)
+	}
+	if _, err := cli.ContainerInspect(context.Background(), id); !client.IsErrNotFound(err) {
+		t.Fatalf("container still exists after stop: %v", err)
+	}
+}
+
+func BenchmarkInspect(b *testing.B) {
+	requireDocker(b)
+	c := sleeper(b)
+	if err := c.CreateContainer(); err != nil {
+		b.Fatal(err)
+	}
+	defer c.Stop()
+
+	for _, size := range []bool{false, true} {
+		b.Run("size="+strconv.FormatBool(size), func(b *testing.B) {
+			c.sizeAccounting = size
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Inspect(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMacAddressAndStaticIPOnSameNetwork(t *testing.T) {
+	requireDocker(t)
+	const (
+		ip  = "172.29.91.10"
+		mac = "02:42:ac:1d:5b:0a"
+	)
+	n, err := NewNetwork(testName(t), WithNetworkSubnet("172.29.91.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.CreateNetwork(); err != nil {
+		t.Fatal(err)
+	}
+	defer n.Remove()
+
+	c := sleeper(t, WithNetwork(n.Name), WithStaticIP(n.Name, ip), WithMacAddress(n.Name, mac))
+	if err = c.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	info, err := c.Inspect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := info.NetworkSettings.Networks[n.Name]
+	if endpoint == nil {
+		t.Fatalf("container is not attached to network %s", n.Name)
+	}
+	if endpoint.IPAddress != ip || endpoint.MacAddress != mac {
+		t.Fatalf("expected %s and %s, got %s and %s", ip, mac, endpoint.IPAddress, endpoint.MacAddress)
+	}
+}
+
+func TestPortRangeKeepsContainerPortBinding(t *testing.T) {
+	c, err := NewContainer(testImage, "30001", WithHostPort("9000"), WithPortRange(30000, 30002, "tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings, err := c.portBindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 3 {
+		t.Fatalf("expected 3 published ports, got %v", bindings)
+	}
+	if binding := bindings["30001/tcp"]; len(binding) != 1 || binding[0].HostPort != "9000" {
+		t.Fatalf("container port lost its binding to 9000: %v", binding)
+	}
+}
+
+func TestSecretFileBelongsToContainerUser(t *testing.T) {
+	requireDocker(t)
+	//guest is uid 405 in alpine, its primary group is users, gid 100
+	asGuest := func(c *Container) {
+		c.User = "guest"
+	}
+	output, exitCode, err := Run(context.Background(), testImage,
+		[]string{"sh", "-c", "cat /run/secrets/token && stat -c ' %u:%g %a' /run/secrets/token"},
+		asGuest, WithSecretFile("/run/secrets/token", []byte("s3cret")))
+	if err != nil || exitCode != 0 {
+		t.Fatalf("unable to read secret as guest, exit code %d: %v\n%s", exitCode, err, output)
+	}
+	if expected := "s3cret 405:100 400"; strings.TrimSpace(output) != expected {
+		t.Fatalf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestValidateMountsChecksTargetType(t *testing.T) {
+	requireDocker(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "nginx.conf")
+	if err := os.WriteFile(file, []byte("events {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bind := range []string{
+		file + ":/etc",       //A file onto a directory of the image
+		dir + ":/etc/passwd", //A directory onto a file of the image
+		file + ":/data/",     //A file onto a target marked as a directory
+	} {
+		c := sleeper(t, WithBindHostConfig([]string{bind}), WithValidateMounts())
+		if err := c.CreateContainer(); err == nil {
+			c.Stop()
+			t.Errorf("bind %s was not rejected", bind)
+		}
+	}
+
+	c := sleeper(t, WithBindHostConfig([]string{file + ":/etc/nginx.conf", dir + ":/etc/conf.d"}), WithValidateMounts())
+	if err := c.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+	c.Stop()
+}
@@ -0,0 +1,200 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// Group handles several containers together, each one identified by the name
+// it was added with. Containers are started in the order they were added, each
+// one as soon as its image is pulled, images being pulled in the background.
+//
+// Every container joins a network named after the group, where the other
+// members resolve it by its name. The network is created by StartAll and
+// removed by StopAll, unless it already existed.
+type Group struct {
+	name            string
+	names           []string
+	containers      map[string]*Container
+	networkOptions  []func(*Network)
+	network         *Network
+	ownsNetwork     bool
+	pullConcurrency int
+}
+
+// WithGroupNetwork configures the network created for the group, e.g: with
+// WithNetworkSubnet to avoid overlapping with host routes.
+func WithGroupNetwork(options ...func(*Network)) func(*Group) {
+	return func(g *Group) {
+		g.networkOptions = append(g.networkOptions, options...)
+	}
+}
+
+// WithPullConcurrency bounds how many images StartAll pulls at once, e.g: to
+// stay below registry rate limits. Pulls are not bounded by default.
+func WithPullConcurrency(n int) func(*Group) {
+	return func(g *Group) {
+		g.pullConcurrency = n
+	}
+}
+
+func NewGroup(name string, options ...func(*Group)) (*Group, error) {
+	if name == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+	conf := &Group{name: name, containers: map[string]*Container{}}
+	for _, opt := range options {
+		opt(conf)
+	}
+	//The network is created lazily, its options are validated right away
+	if _, err := NewNetwork(name, conf.networkOptions...); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (g *Group) Add(name string, c *Container) error {
+	if name == "" {
+		return errors.New("name cannot be empty")
+	}
+	if _, ok := g.containers[name]; ok {
+		return errors.Errorf("container %s already in group", name)
+	}
+	WithNetwork(g.name, name)(c)
+	g.names = append(g.names, name)
+	g.containers[name] = c
+	return nil
+}
+
+// StartAll starts the containers in the order they were added. On a failure
+// the remaining pulls are cancelled and nothing else is started, the containers
+// already started are left running for inspection until StopAll.
+func (g *Group) StartAll() error {
+	if err := g.ensureNetwork(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pulls := g.pullImages(ctx)
+	for _, name := range g.names {
+		if err := <-pulls[name]; err != nil {
+			return errors.Wrapf(err, "unable to start container %s", name)
+		}
+		if err := g.containers[name].CreateContainer(); err != nil {
+			return errors.Wrapf(err, "unable to start container %s", name)
+		}
+	}
+	return nil
+}
+
+// pullImages pulls the image of every container in the background, at most
+// pullConcurrency at once, and tells by name when each one is done.
+func (g *Group) pullImages(ctx context.Context) map[string]<-chan error {
+	var slots chan struct{}
+	if g.pullConcurrency > 0 {
+		slots = make(chan struct{}, g.pullConcurrency)
+	}
+	pulls := make(map[string]<-chan error, len(g.names))
+	for _, name := range g.names {
+		done := make(chan error, 1)
+		pulls[name] = done
+		go func(c *Container) {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					done <- ctx.Err()
+					return
+				}
+			}
+			done <- c.prefetchImage(ctx)
+		}(g.containers[name])
+	}
+	return pulls
+}
+
+// StopAll stops the containers in the reverse order they were started, so
+// dependents go away before what they depend on. A failure does not interrupt
+// it, they are all returned together. The network is only removed once every
+// container is, otherwise it is kept and reported along with the failures.
+func (g *Group) StopAll() error {
+	var failures []string
+	for i := len(g.names) - 1; i >= 0; i-- {
+		name := g.names[i]
+		for _, err := range g.containers[name].stop() {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	switch {
+	case g.network == nil || !g.ownsNetwork:
+		g.network = nil
+	case len(failures) > 0:
+		failures = append(failures, fmt.Sprintf("network %s not removed, containers may still be attached", g.name))
+	default:
+		if err := g.network.Remove(); err != nil {
+			failures = append(failures, fmt.Sprintf("network %s: %v", g.name, err))
+			break
+		}
+		g.network = nil
+	}
+
+	if len(failures) > 0 {
+		return errors.Errorf("unable to stop group %s: %s", g.name, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (g *Group) ensureNetwork() error {
+	if g.network != nil {
+		return nil
+	}
+	network, err := NewNetwork(g.name, g.networkOptions...)
+	if err != nil {
+		return err
+	}
+	created, err := network.createIfMissing()
+	if err != nil {
+		return errors.Wrapf(err, "unable to set up network of group %s", g.name)
+	}
+	g.network = network
+	g.ownsNetwork = created
+	return nil
+}
+
+// WaitAll waits for every container of the group to exit and returns their
+// exit codes by name. Containers still running when ctx is done are reported
+// in the error, the codes of the others are returned anyway.
+func (g *Group) WaitAll(ctx context.Context) (map[string]int64, error) {
+	type result struct {
+		name string
+		code int64
+		err  error
+	}
+	results := make(chan result, len(g.names))
+	for _, name := range g.names {
+		go func(name string, c *Container) {
+			code, err := c.wait(ctx)
+			results <- result{name: name, code: code, err: err}
+		}(name, g.containers[name])
+	}
+
+	codes := make(map[string]int64, len(g.names))
+	var failures []string
+	for range g.names {
+		r := <-results
+		if r.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", r.name, r.err))
+			continue
+		}
+		codes[r.name] = r.code
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return codes, errors.Errorf("containers did not exit: %s", strings.Join(failures, "; "))
+	}
+	return codes, nil
+}
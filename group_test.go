@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStopAllStopsInReverseOrder(t *testing.T) {
+	cli := requireDocker(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	g, err := NewGroup(testName(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"database", "cache", "app"}
+	for _, name := range names {
+		if err = g.Add(name, sleeper(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = g.StartAll(); err != nil {
+		g.StopAll()
+		t.Fatal(err)
+	}
+	ids := map[string]string{}
+	for _, name := range names {
+		ids[g.containers[name].ID()] = name
+	}
+
+	//Events are replayed from since, none can be missed while subscribing
+	since := strconv.FormatInt(time.Now().Unix(), 10)
+	if err = g.StopAll(); err != nil {
+		t.Fatal(err)
+	}
+	messages, errs := cli.Events(ctx, types.EventsOptions{
+		Since: since,
+		Filters: filters.NewArgs(
+			filters.Arg("type", "container"),
+			filters.Arg("event", "die"),
+			filters.Arg("label", SessionLabel+"="+sessionID),
+		),
+	})
+	var stopped []string
+	for len(stopped) < len(names) {
+		select {
+		case m := <-messages:
+			if name, ok := ids[m.Actor.ID]; ok {
+				stopped = append(stopped, name)
+			}
+		case err = <-errs:
+			t.Fatalf("unable to read events, stopped %v: %v", stopped, err)
+		}
+	}
+	if expected := []string{"app", "cache", "database"}; !reflect.DeepEqual(stopped, expected) {
+		t.Fatalf("expected stop order %v, got %v", expected, stopped)
+	}
+}
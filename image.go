@@ -0,0 +1,37 @@
+package docker
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// VerifyMultiArch pulls ref once per platform, e.g: "linux/arm64", and returns
+// the outcome of each pull by platform. Pulls are independent, a failing
+// platform does not prevent the others from being checked.
+func VerifyMultiArch(ctx context.Context, cli *client.Client, ref string, platforms []string) (map[string]error, error) {
+	if ref == "" {
+		return nil, errors.New("ref cannot be empty")
+	}
+	if len(platforms) == 0 {
+		return nil, errors.New("platforms cannot be empty")
+	}
+
+	results := make(map[string]error, len(platforms))
+	for _, platform := range platforms {
+		results[platform] = pull(ctx, cli, ref, types.ImagePullOptions{Platform: platform})
+	}
+	return results, nil
+}
+
+// PruneDanglingImages removes the untagged images left behind by builds and
+// returns the disk space reclaimed, in bytes. Containers are not pruned.
+func PruneDanglingImages(ctx context.Context, cli *client.Client) (uint64, error) {
+	report, err := cli.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "true")))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to prune images")
+	}
+	return report.SpaceReclaimed, nil
+}
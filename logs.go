@@ -0,0 +1,105 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// WithLogStreaming copies the container logs to w while it runs, each line
+// starting with prefix, or with the short container ID when prefix is empty.
+// Prefixes are colored when w is a terminal, so several containers can share it.
+func WithLogStreaming(w io.Writer, prefix string) func(*Container) {
+	return func(c *Container) {
+		c.logStream = w
+		c.logPrefix = prefix
+	}
+}
+
+func streamLogs(cli *client.Client, id string, w io.Writer, prefix string) {
+	if prefix == "" {
+		prefix = shortID(id)
+	}
+	reader, err := cli.ContainerLogs(context.Background(), id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		log.Printf("unable to stream container logs: %v", err)
+		return
+	}
+	defer reader.Close()
+
+	out := newPrefixWriter(w, prefix)
+	if _, err = stdcopy.StdCopy(out, out, reader); err != nil {
+		log.Printf("unable to stream container logs: %v", err)
+	}
+	out.flush()
+}
+
+var prefixColors = []int{31, 32, 33, 34, 35, 36}
+
+// streamMu serializes the lines of every streamed container, they may share a writer.
+var streamMu sync.Mutex
+
+// prefixWriter writes what it receives line by line, each one starting with a prefix.
+type prefixWriter struct {
+	w       io.Writer
+	prefix  []byte
+	pending []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	if isTerminal(w) {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(prefix))
+		prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", prefixColors[h.Sum32()%uint32(len(prefixColors))], prefix)
+	}
+	return &prefixWriter{w: w, prefix: []byte(prefix + " | ")}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	for {
+		i := bytes.IndexByte(p.pending, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.pending[:i+1]); err != nil {
+			return 0, err
+		}
+		p.pending = p.pending[i+1:]
+	}
+}
+
+func (p *prefixWriter) flush() {
+	if len(p.pending) > 0 {
+		_ = p.writeLine(append(p.pending, '\n'))
+		p.pending = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,187 @@
+package docker
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+)
+
+// Network is a user-defined docker network containers can join through WithNetwork.
+//
+// Overlay networks need the daemon to be part of a swarm (`docker swarm init`)
+// and must be created from a manager node. Standalone containers can only join
+// them when they are attachable, so NewNetwork turns Attachable on for the
+// overlay driver. On multi-node swarms, ports 2377/tcp, 7946/tcp+udp and
+// 4789/udp must be open between the nodes.
+type Network struct {
+	Name       string // Name of the network, used by WithNetwork
+	Driver     string // "bridge" by default
+	Attachable bool   // Allows standalone containers to join a swarm-scoped network
+	Subnet     string // Subnet of the network in CIDR format, picked by the daemon when empty
+	Gateway    string // Gateway of the subnet, picked by the daemon when empty
+	IPRange    string // Range of the subnet containers get their IP from, in CIDR format
+	client     *client.Client
+	id         string
+	optionErr  error
+}
+
+func WithNetworkDriver(driver string) func(*Network) {
+	return func(n *Network) {
+		n.Driver = driver
+	}
+}
+
+func WithAttachable() func(*Network) {
+	return func(n *Network) {
+		n.Attachable = true
+	}
+}
+
+func WithNetworkSubnet(cidr string) func(*Network) {
+	return func(n *Network) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			n.setOptionError(errors.Wrap(err, "invalid subnet"))
+			return
+		}
+		n.Subnet = cidr
+	}
+}
+
+func WithNetworkGateway(ip string) func(*Network) {
+	return func(n *Network) {
+		if net.ParseIP(ip) == nil {
+			n.setOptionError(errors.Errorf("invalid gateway %s", ip))
+			return
+		}
+		n.Gateway = ip
+	}
+}
+
+func WithNetworkIPRange(cidr string) func(*Network) {
+	return func(n *Network) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			n.setOptionError(errors.Wrap(err, "invalid IP range"))
+			return
+		}
+		n.IPRange = cidr
+	}
+}
+
+func NewNetwork(name string, options ...func(*Network)) (*Network, error) {
+	if name == "" {
+		return nil, errors.New("name cannot be empty")
+	}
+
+	conf := &Network{
+		Name:   name,
+		Driver: "bridge",
+	}
+	for _, opt := range options {
+		opt(conf)
+	}
+	if conf.optionErr != nil {
+		return nil, conf.optionErr
+	}
+	if conf.Driver == "overlay" {
+		conf.Attachable = true
+	}
+	if err := conf.validateIPAM(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (n *Network) setOptionError(err error) {
+	if n.optionErr == nil {
+		n.optionErr = err
+	}
+}
+
+func (n *Network) validateIPAM() error {
+	if n.Subnet == "" {
+		if n.Gateway != "" || n.IPRange != "" {
+			return errors.New("gateway and IP range need a subnet")
+		}
+		return nil
+	}
+	_, subnet, _ := net.ParseCIDR(n.Subnet)
+	if n.Gateway != "" && !subnet.Contains(net.ParseIP(n.Gateway)) {
+		return errors.Errorf("gateway %s is not in subnet %s", n.Gateway, n.Subnet)
+	}
+	if n.IPRange != "" {
+		ip, _, _ := net.ParseCIDR(n.IPRange)
+		if !subnet.Contains(ip) {
+			return errors.Errorf("IP range %s is not in subnet %s", n.IPRange, n.Subnet)
+		}
+	}
+	return nil
+}
+
+func (n *Network) ipam() *network.IPAM {
+	if n.Subnet == "" {
+		return nil
+	}
+	return &network.IPAM{
+		Config: []network.IPAMConfig{{
+			Subnet:  n.Subnet,
+			Gateway: n.Gateway,
+			IPRange: n.IPRange,
+		}},
+	}
+}
+
+func (n *Network) CreateNetwork() error {
+	cli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+	if err != nil {
+		return errors.Wrap(err, "unable to create docker client")
+	}
+
+	resp, err := cli.NetworkCreate(context.Background(), n.Name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         n.Driver,
+		Attachable:     n.Attachable,
+		IPAM:           n.ipam(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to create network")
+	}
+	if resp.Warning != "" {
+		log.Printf("network %s created with warning: %s", n.Name, resp.Warning)
+	}
+
+	n.id = resp.ID
+	n.client = cli
+
+	return nil
+}
+
+// createIfMissing reuses the network when it already exists and reports
+// whether it had to be created.
+func (n *Network) createIfMissing() (bool, error) {
+	cli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, errors.Wrap(err, "unable to create docker client")
+	}
+
+	existing, err := cli.NetworkInspect(context.Background(), n.Name, types.NetworkInspectOptions{})
+	if err == nil {
+		n.id = existing.ID
+		n.client = cli
+		return false, nil
+	}
+	if !client.IsErrNotFound(err) {
+		return false, errors.Wrap(err, "unable to inspect network")
+	}
+	return true, n.CreateNetwork()
+}
+
+func (n *Network) Remove() error {
+	if err := n.client.NetworkRemove(context.Background(), n.id); err != nil {
+		return errors.Wrap(err, "unable to remove network")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package docker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// SessionLabel is stamped on every container created by this package, with
+// SessionID as its value, unless WithoutSessionLabel is used.
+const SessionLabel = "docker-utils.session"
+
+var sessionID = newSessionID()
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("unable to generate session ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SessionID identifies the containers created by the current process.
+func SessionID() string {
+	return sessionID
+}
+
+func WithoutSessionLabel() func(*Container) {
+	return func(c *Container) {
+		c.noSessionLabel = true
+	}
+}
+
+// PruneContainers force removes the containers, running or not, matching every
+// given label filter, e.g: "app=db", and returns how many were removed. It
+// defaults to the containers of the current session.
+func PruneContainers(ctx context.Context, cli *client.Client, labels ...string) (int, error) {
+	if len(labels) == 0 {
+		labels = []string{SessionLabel + "=" + sessionID}
+	}
+	args := filters.NewArgs()
+	for _, label := range labels {
+		args.Add("label", label)
+	}
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to list containers")
+	}
+	removed := 0
+	for _, cont := range containers {
+		if err = cli.ContainerRemove(ctx, cont.ID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+			return removed, errors.Wrapf(err, "unable to remove container %s", shortID(cont.ID))
+		}
+		removed++
+	}
+	return removed, nil
+}
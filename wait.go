@@ -0,0 +1,318 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Streams WithWaitForLogStream can restrict its matching to.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+type logWait struct {
+	stream    string
+	substring string
+	timeout   time.Duration
+}
+
+// WithWaitForLog makes the container ready once substring shows up in its
+// logs, on stdout or stderr, within timeout. The wait happens after Sleep.
+func WithWaitForLog(substring string, timeout time.Duration) func(*Container) {
+	return WithWaitForLogStream("", substring, timeout)
+}
+
+// WithWaitForLogStream behaves like WithWaitForLog but only matches lines
+// written to the given stream, StreamStdout or StreamStderr. An empty stream
+// matches both.
+func WithWaitForLogStream(stream, substring string, timeout time.Duration) func(*Container) {
+	return func(c *Container) {
+		if stream != "" && stream != StreamStdout && stream != StreamStderr {
+			c.setOptionError(errors.Errorf("unknown log stream %s", stream))
+			return
+		}
+		if substring == "" {
+			c.setOptionError(errors.New("log substring cannot be empty"))
+			return
+		}
+		c.logWait = &logWait{stream: stream, substring: substring, timeout: timeout}
+	}
+}
+
+var (
+	errLogFound         = errors.New("log found")
+	errContainerStopped = errors.New("container stopped")
+	errRestarting       = errors.New("container is restarting")
+)
+
+// WithToleranceForRestarts lets the readiness waits and WaitForHealthResult go
+// on when the container restarts, per its restart policy, at most n times:
+// logs are followed again and health is polled through the restart.
+func WithToleranceForRestarts(n int) func(*Container) {
+	return func(c *Container) {
+		c.restartTolerance = n
+	}
+}
+
+func waitForLog(ctx context.Context, cli *client.Client, id string, wait *logWait, restarts int) error {
+	ctx, cancel := context.WithTimeout(ctx, wait.timeout)
+	defer cancel()
+
+	for {
+		err := followForLog(ctx, cli, id, wait)
+		if err != errContainerStopped {
+			return err
+		}
+		if err = waitForRestart(ctx, cli, id, restarts); err != nil {
+			return errors.Wrapf(err, "container stopped before logging %q", wait.substring)
+		}
+	}
+}
+
+func followForLog(ctx context.Context, cli *client.Client, id string, wait *logWait) error {
+	reader, err := cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to follow container logs")
+	}
+	defer reader.Close()
+
+	stdout := &logMatcher{substring: []byte(wait.substring), enabled: wait.stream != StreamStderr}
+	stderr := &logMatcher{substring: []byte(wait.substring), enabled: wait.stream != StreamStdout}
+	_, err = stdcopy.StdCopy(stdout, stderr, reader)
+	switch {
+	case err == errLogFound:
+		return nil
+	case ctx.Err() != nil:
+		return errors.Errorf("%q not found in container logs after %s", wait.substring, wait.timeout)
+	case err != nil:
+		return errors.Wrap(err, "unable to read container logs")
+	default:
+		return errContainerStopped
+	}
+}
+
+// waitForRestart waits for a stopped container to run again.
+func waitForRestart(ctx context.Context, cli *client.Client, id string, restarts int) error {
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+	for {
+		info, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return errors.Wrap(err, "unable to inspect container")
+		}
+		if err = checkRestarts(info, restarts); err != nil {
+			return err
+		}
+		if info.State.Running {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.New("container did not restart in time")
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkRestarts fails unless the container is running or restarting within
+// the number of tolerated restarts.
+func checkRestarts(info types.ContainerJSON, restarts int) error {
+	switch {
+	case info.State.Running && info.RestartCount <= restarts:
+		return nil
+	case info.State.Restarting && info.RestartCount < restarts:
+		return nil
+	case info.State.Running || info.State.Restarting:
+		return errors.Errorf("container restarted more than %d times", restarts)
+	default:
+		return errors.Errorf("container exited with code %d", info.State.ExitCode)
+	}
+}
+
+// logMatcher is an io.Writer failing with errLogFound once substring was written to it.
+type logMatcher struct {
+	substring []byte
+	enabled   bool
+	tail      []byte
+}
+
+func (m *logMatcher) Write(p []byte) (int, error) {
+	if !m.enabled {
+		return len(p), nil
+	}
+	data := append(m.tail, p...)
+	if bytes.Contains(data, m.substring) {
+		return len(p), errLogFound
+	}
+	//Keeps enough bytes to match a substring split across writes
+	if keep := len(m.substring) - 1; len(data) > keep {
+		data = data[len(data)-keep:]
+	}
+	m.tail = append(m.tail[:0], data...)
+	return len(p), nil
+}
+
+const healthPollInterval = 500 * time.Millisecond
+
+// WaitForHealthResult polls the container's healthcheck until it leaves the
+// starting state and returns the status it reached, "healthy" or "unhealthy".
+// Errors are only returned when no such result was observed. The output of the
+// last check is logged on an unhealthy result, Inspect returns the whole log.
+func (c *Container) WaitForHealthResult(ctx context.Context, timeout time.Duration) (string, error) {
+	if c.id == "" {
+		return "", errors.New("container is not created")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+	for {
+		info, err := c.client.ContainerInspect(ctx, c.id)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to inspect container")
+		}
+		health := info.State.Health
+		if health == nil || health.Status == types.NoHealthcheck {
+			return "", errors.New("container has no healthcheck")
+		}
+		if err = checkRestarts(info, c.restartTolerance); err != nil {
+			return health.Status, err
+		}
+		//While restarting, the status is the one of the previous run
+		switch {
+		case !info.State.Running:
+		case health.Status == types.Healthy:
+			return health.Status, nil
+		case health.Status == types.Unhealthy:
+			if len(health.Log) > 0 {
+				log.Printf("container %s is unhealthy, last check output: %s", shortID(c.id), health.Log[len(health.Log)-1].Output)
+			}
+			return health.Status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return health.Status, errors.Errorf("container still %s after %s", health.Status, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// WithWaitForPort makes the container ready once its published port accepts
+// TCP connections within timeout. The address is read back from the daemon on
+// every attempt, so it follows HostIP, a random HostPort and the restarts let
+// through by WithToleranceForRestarts. As docker-proxy accepts connections
+// before anything listens in the container, then closes them, a connection
+// only counts once it stays open for a moment or gets data.
+func WithWaitForPort(timeout time.Duration) func(*Container) {
+	return func(c *Container) {
+		c.portWait = timeout
+	}
+}
+
+// publishedAddress is where the container port can be reached from the host.
+// It fails with errRestarting while the container restarts within tolerance.
+func (c *Container) publishedAddress(ctx context.Context, cli *client.Client, id string) (string, error) {
+	port, err := nat.NewPort(c.ContainerProtocol, c.ContainerPort)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get port")
+	}
+	info, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to inspect container")
+	}
+	if err = checkRestarts(info, c.restartTolerance); err != nil {
+		return "", err
+	}
+	if !info.State.Running {
+		return "", errRestarting
+	}
+	if c.networkMode().IsHost() {
+		return net.JoinHostPort("127.0.0.1", port.Port()), nil
+	}
+	var bindings []nat.PortBinding
+	if info.NetworkSettings != nil {
+		bindings = info.NetworkSettings.Ports[port]
+	}
+	return bindingAddress(port, bindings)
+}
+
+func bindingAddress(port nat.Port, bindings []nat.PortBinding) (string, error) {
+	if len(bindings) == 0 {
+		return "", errors.Errorf("port %s is not published", port)
+	}
+	host := bindings[0].HostIP
+	if ip := net.ParseIP(host); host == "" || ip.IsUnspecified() {
+		//Published on every interface, loopback is one of them
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, bindings[0].HostPort), nil
+}
+
+const (
+	portPollInterval = 200 * time.Millisecond
+	portProbeTimeout = 100 * time.Millisecond
+)
+
+// waitForPort dials the address returned by resolve until it answers, resolve
+// failing with errRestarting only delays the next attempt.
+func waitForPort(ctx context.Context, timeout time.Duration, resolve func(context.Context) (string, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		address, err := resolve(ctx)
+		switch {
+		case err == nil:
+			if err = dialPort(ctx, address); err == nil {
+				return nil
+			}
+		case err != errRestarting && ctx.Err() == nil:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("port not reachable after %s: %v", timeout, err)
+		case <-time.After(portPollInterval):
+		}
+	}
+}
+
+func dialPort(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !portAnswers(conn) {
+		return errors.Errorf("connection to %s closed right after being accepted", address)
+	}
+	return nil
+}
+
+// portAnswers tells whether conn gets data or stays open for portProbeTimeout,
+// rather than being closed by a proxy with nothing listening behind it.
+func portAnswers(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(portProbeTimeout)); err != nil {
+		return false
+	}
+	_, err := conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	return err == nil || ok && netErr.Timeout()
+}
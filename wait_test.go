@@ -0,0 +1,149 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"github.com/docker/go-connections/nat"
+	"github.com/pkg/errors"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBindingAddress(t *testing.T) {
+	port := nat.Port("8080/tcp")
+	for hostIP, expected := range map[string]string{
+		"127.0.0.2": "127.0.0.2:32768",
+		"10.1.2.3":  "10.1.2.3:32768",
+		"0.0.0.0":   "127.0.0.1:32768",
+		"::":        "127.0.0.1:32768",
+		"":          "127.0.0.1:32768",
+	} {
+		address, err := bindingAddress(port, []nat.PortBinding{{HostIP: hostIP, HostPort: "32768"}})
+		if err != nil || address != expected {
+			t.Errorf("host IP %q: expected %s, got %s (%v)", hostIP, expected, address, err)
+		}
+	}
+	if _, err := bindingAddress(port, nil); err == nil {
+		t.Error("expected an error for an unpublished port")
+	}
+}
+
+// listen accepts connections on loopback, handing each of them to handle.
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func fixedAddress(address string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		return address, nil
+	}
+}
+
+func TestWaitForPortIgnoresClosedConnections(t *testing.T) {
+	//Behaves like docker-proxy with nothing listening in the container
+	address := listen(t, func(conn net.Conn) { conn.Close() })
+	if err := waitForPort(context.Background(), time.Second, fixedAddress(address)); err == nil {
+		t.Fatal("port closing every connection was considered ready")
+	}
+}
+
+func TestWaitForPortAcceptsSilentServers(t *testing.T) {
+	address := listen(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+	if err := waitForPort(context.Background(), time.Second, fixedAddress(address)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForPortFollowsRestarts(t *testing.T) {
+	stale := listen(t, func(conn net.Conn) { conn.Close() })
+	moved := listen(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+	//The port is published elsewhere once the container came back
+	attempts := 0
+	resolve := func(context.Context) (string, error) {
+		attempts++
+		switch {
+		case attempts < 3:
+			return stale, nil
+		case attempts < 5:
+			return "", errRestarting
+		default:
+			return moved, nil
+		}
+	}
+	if err := waitForPort(context.Background(), 5*time.Second, resolve); err != nil {
+		t.Fatal(err)
+	}
+
+	exited := errors.New("container exited with code 1")
+	resolve = func(context.Context) (string, error) { return "", exited }
+	if err := waitForPort(context.Background(), 5*time.Second, resolve); err != exited {
+		t.Fatalf("expected the restart check to end the wait, got %v", err)
+	}
+}
+
+func TestWaitForPortOnHostIP(t *testing.T) {
+	requireDocker(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.2 is only a loopback address on linux")
+	}
+	//The server only listens after a while, docker-proxy accepts connections before
+	c, err := NewContainer(testImage, "8080",
+		withTestCmd("sh", "-c", "sleep 2; exec httpd -f -p 8080"),
+		WithHostIP("127.0.0.2"),
+		WithHostPort(""),
+		WithWaitForPort(30*time.Second),
+		WithStopTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	address, err := c.publishedAddress(context.Background(), c.client, c.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(address, "127.0.0.2:") {
+		t.Fatalf("expected the port to be published on 127.0.0.2, got %s", address)
+	}
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/") {
+		t.Fatalf("server not ready once the wait returned: %q, %v", status, err)
+	}
+}